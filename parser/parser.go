@@ -0,0 +1,606 @@
+// Package parser extracts struct type declarations from Go source files and
+// packages, resolving embedded fields according to Go's own name-resolution
+// rules so that QuerySet generation sees the same field set the Go compiler
+// would.
+package parser
+
+import (
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing/fstest"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// Source abstracts where parser reads Go source files from, so callers can
+// drive it from something other than the real filesystem, e.g. in tests or
+// from a go:embed-ed schema.
+type Source interface {
+	fs.FS
+}
+
+// OSSource reads files straight from the OS filesystem. Unlike a strict
+// fs.FS it accepts the absolute or relative paths Go tooling normally uses,
+// not just slash-separated paths rooted below a single directory.
+type OSSource struct{}
+
+// Open implements Source.
+func (OSSource) Open(name string) (fs.File, error) {
+	return os.Open(name)
+}
+
+// MemSource returns a Source serving files purely from memory, keyed by
+// their path (e.g. "model.go" or "models/base.go"). It's meant for tests
+// and other callers that want to drive the parser without touching disk.
+func MemSource(files map[string]string) Source {
+	memFS := make(fstest.MapFS, len(files))
+	for name, content := range files {
+		memFS[name] = &fstest.MapFile{Data: []byte(content)}
+	}
+
+	return memFS
+}
+
+// Field is a single field of a struct after embedding has been resolved:
+// a field promoted through an anonymous struct field is reported here just
+// like one declared directly.
+//
+// This is a deliberate, breaking departure from returning a bare *ast.Field
+// per field: a promoted field's *ast.Field belongs to the embedded struct,
+// not the one callers asked about, and per-field Doc/LineComment still need
+// somewhere to live once comments are parsed out of it. Wrapping both in one
+// struct now avoids a second breaking change later; there is no in-tree
+// caller of the old map[ast.TypeSpec][]*ast.Field shape to migrate.
+type Field struct {
+	// Name is the identifier the field is accessed by, e.g. "ID" for a
+	// field promoted from an embedded "m" struct.
+	Name *ast.Ident
+	// AST is the *ast.Field the name was actually declared on. For a
+	// promoted field this is the field in the embedded struct, not the
+	// embedding one. It's nil for a field of a struct declared in another
+	// package (e.g. X promoted from an embedded image.Point), whose syntax
+	// isn't searched for fields.
+	AST *ast.Field
+	// Doc is the field's lead comment (the "// ..." or "/* ... */" group
+	// directly above it), with comment markers stripped. It's empty if the
+	// field has none.
+	Doc string
+	// LineComment is the field's trailing same-line comment, with comment
+	// markers stripped. It's empty if the field has none.
+	LineComment string
+}
+
+func newField(name *ast.Ident, astField *ast.Field) *Field {
+	f := &Field{Name: name, AST: astField}
+	if astField.Doc != nil {
+		f.Doc = commentGroupText(astField.Doc)
+	}
+	if astField.Comment != nil {
+		f.LineComment = commentGroupText(astField.Comment)
+	}
+
+	return f
+}
+
+// commentGroupText renders cg the way CommentGroup.Text() does (comment
+// markers stripped, one line per comment, trailing newline), except it also
+// trims the space a "/* ... */" block comment leaves around its content,
+// so a block doc comment and an equivalent "//" one produce identical text.
+func commentGroupText(cg *ast.CommentGroup) string {
+	lines := make([]string, 0, len(cg.List))
+	for _, c := range cg.List {
+		text := c.Text
+		switch {
+		case strings.HasPrefix(text, "//"):
+			lines = append(lines, strings.TrimSpace(strings.TrimPrefix(text, "//")))
+		case strings.HasPrefix(text, "/*"):
+			text = strings.TrimSuffix(strings.TrimPrefix(text, "/*"), "*/")
+			for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+				lines = append(lines, strings.TrimSpace(line))
+			}
+		}
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+const loadMode = packages.NeedName | packages.NeedFiles | packages.NeedSyntax |
+	packages.NeedTypes | packages.NeedTypesInfo | packages.NeedDeps
+
+// loadPackage loads the package at dir the way the ctx build context would
+// see it, honoring GOOS/GOARCH and build tags so that files excluded by a
+// `//go:build` constraint don't leak into the returned syntax. extraEnv is
+// layered on top of the environment derived from ctx.
+func loadPackage(dir string, ctx *build.Context, extraEnv ...string) (*packages.Package, error) {
+	pkgs, err := loadPackages(dir, ctx, false, extraEnv...)
+	if err != nil {
+		return nil, err
+	}
+
+	pkg := pkgs[0]
+	if len(pkg.Errors) > 0 {
+		return nil, fmt.Errorf("can't load package at %q: %s", dir, pkg.Errors[0])
+	}
+
+	return pkg, nil
+}
+
+// loadPackages is loadPackage's plural form: with tests set it also asks
+// `go list` for dir's test-augmented package variants, which is the only
+// way to see a _test.go file's own syntax (go/packages otherwise loads only
+// the production package).
+func loadPackages(dir string, ctx *build.Context, tests bool, extraEnv ...string) ([]*packages.Package, error) {
+	if ctx == nil {
+		ctx = &build.Default
+	}
+
+	cfg := &packages.Config{
+		Mode:  loadMode,
+		Dir:   dir,
+		Env:   append(buildContextEnv(ctx), extraEnv...),
+		Tests: tests,
+	}
+	if len(ctx.BuildTags) > 0 {
+		cfg.BuildFlags = []string{"-tags=" + strings.Join(ctx.BuildTags, ",")}
+	}
+
+	pkgs, err := packages.Load(cfg, ".")
+	if err != nil {
+		return nil, fmt.Errorf("can't load package at %q: %s", dir, err)
+	}
+	if len(pkgs) == 0 {
+		return nil, fmt.Errorf("no package found at %q", dir)
+	}
+
+	// Errors are deliberately not checked here: with tests set, pkgs holds
+	// several variants (production, internal test, external test), and a
+	// broken one unrelated to the file a caller actually wants shouldn't
+	// fail the whole load. Callers check Errors on the specific package
+	// they end up using.
+	return pkgs, nil
+}
+
+// packageContainingFile returns whichever of pkgs has absPath among its
+// parsed files, or nil if none does.
+func packageContainingFile(pkgs []*packages.Package, absPath string) *packages.Package {
+	for _, pkg := range pkgs {
+		for _, file := range pkg.Syntax {
+			if pkg.Fset.Position(file.Pos()).Filename == absPath {
+				return pkg
+			}
+		}
+	}
+
+	return nil
+}
+
+// buildContextEnv turns the GOOS/GOARCH of ctx into `go list`-understood
+// environment overrides, layered on top of the current environment.
+func buildContextEnv(ctx *build.Context) []string {
+	env := os.Environ()
+	if ctx.GOOS != "" {
+		env = append(env, "GOOS="+ctx.GOOS)
+	}
+	if ctx.GOARCH != "" {
+		env = append(env, "GOARCH="+ctx.GOARCH)
+	}
+
+	return env
+}
+
+// materializedEnv returns the environment overrides a scratch directory
+// created by materializeDir needs: its go.mod only works if module mode is
+// actually on, regardless of how the ambient environment is configured.
+func materializedEnv(src Source) []string {
+	if _, ok := src.(OSSource); ok {
+		return nil
+	}
+
+	return []string{"GO111MODULE=on"}
+}
+
+// materializeDir makes sure dir, as seen through src, exists as a real
+// directory that go/packages (which always shells out to the go tool) can
+// load. For OSSource dir already is a real directory and this is a no-op.
+// For any other Source, the *.go files directly inside dir are copied into
+// a scratch directory that the returned cleanup func removes.
+func materializeDir(src Source, dir string) (realDir string, cleanup func(), err error) {
+	if _, ok := src.(OSSource); ok {
+		return dir, func() {}, nil
+	}
+
+	tmpDir, err := ioutil.TempDir("", "go-queryset-parser")
+	if err != nil {
+		return "", nil, fmt.Errorf("can't create scratch dir for %q: %s", dir, err)
+	}
+	cleanup = func() { os.RemoveAll(tmpDir) }
+
+	// go/packages always drives `go list`, which since Go 1.16 refuses to
+	// run outside a module, so the scratch dir needs its own go.mod even
+	// though it never has any requirements to resolve.
+	goMod := []byte("module go-queryset-parser-scratch\n\ngo 1.16\n")
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "go.mod"), goMod, 0644); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("can't write go.mod for %q: %s", dir, err)
+	}
+
+	entries, err := fs.ReadDir(src, dir)
+	if err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("can't read dir %q: %s", dir, err)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".go") {
+			continue
+		}
+
+		data, err := fs.ReadFile(src, path.Join(dir, entry.Name()))
+		if err != nil {
+			cleanup()
+			return "", nil, fmt.Errorf("can't read %q: %s", entry.Name(), err)
+		}
+
+		if err := ioutil.WriteFile(filepath.Join(tmpDir, entry.Name()), data, 0644); err != nil {
+			cleanup()
+			return "", nil, fmt.Errorf("can't write %q: %s", entry.Name(), err)
+		}
+	}
+
+	return tmpDir, cleanup, nil
+}
+
+// fieldByVar maps every *types.Var declared as a struct field in pkg back to
+// the Field wrapping its originating *ast.Field, including anonymous
+// (embedded) fields whose single implicit name still gets its own *types.Var.
+func fieldByVar(pkg *packages.Package) map[*types.Var]*Field {
+	ret := map[*types.Var]*Field{}
+
+	for _, file := range pkg.Syntax {
+		ast.Inspect(file, func(n ast.Node) bool {
+			astField, ok := n.(*ast.Field)
+			if !ok {
+				return true
+			}
+
+			if len(astField.Names) == 0 {
+				if ident := embeddedFieldIdent(astField.Type); ident != nil {
+					if v, ok := pkg.TypesInfo.Defs[ident].(*types.Var); ok {
+						ret[v] = newField(ident, astField)
+					}
+				}
+				return true
+			}
+
+			for _, name := range astField.Names {
+				if v, ok := pkg.TypesInfo.Defs[name].(*types.Var); ok {
+					ret[v] = newField(name, astField)
+				}
+			}
+
+			return true
+		})
+	}
+
+	return ret
+}
+
+// embeddedFieldIdent returns the identifier an anonymous field is embedded
+// under, e.g. "Point" for both "image.Point" and "*image.Point".
+func embeddedFieldIdent(expr ast.Expr) *ast.Ident {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		return t
+	case *ast.StarExpr:
+		return embeddedFieldIdent(t.X)
+	case *ast.SelectorExpr:
+		return t.Sel
+	default:
+		return nil
+	}
+}
+
+// fieldForVar returns the Field byVar has for v, or a synthetic one built
+// straight from v when there isn't one. The latter happens for fields of a
+// struct whose declaration lives in a package that wasn't parsed into
+// pkg.Syntax, e.g. a type embedded from an imported package such as
+// image.Point: byVar only ever sees *ast.Field nodes from the loaded
+// package's own files.
+func fieldForVar(v *types.Var, byVar map[*types.Var]*Field) *Field {
+	if f, ok := byVar[v]; ok {
+		return f
+	}
+
+	return &Field{Name: ast.NewIdent(v.Name())}
+}
+
+// underlyingStruct returns both the struct shape t (or *t) embeds and the
+// *types.Named identity it came from, the latter used to detect cyclic
+// embedding.
+func underlyingStruct(t types.Type) (*types.Named, *types.Struct, bool) {
+	if ptr, ok := t.(*types.Pointer); ok {
+		t = ptr.Elem()
+	}
+
+	named, ok := t.(*types.Named)
+	if !ok {
+		return nil, nil, false
+	}
+
+	s, ok := named.Underlying().(*types.Struct)
+	return named, s, ok
+}
+
+// flattenFields walks structType and expands anonymous fields into their
+// promoted fields. Fields declared directly on structType always win over
+// ones promoted from an embedded struct, and a name promoted from more than
+// one embedded struct at the same depth is dropped as ambiguous, matching
+// how the Go compiler resolves selectors.
+func flattenFields(structType *types.Struct, byVar map[*types.Var]*Field) []*Field {
+	fields, _ := flattenFieldsVisiting(structType, byVar, map[*types.Named]bool{})
+	return fields
+}
+
+// flattenFieldsVisiting is flattenFields' recursive core. visiting holds the
+// named types currently being expanded on this path; a type embedding
+// itself, directly or through a cycle of other embeds (legal Go as long as
+// the embed is a pointer, e.g. `type T struct { *T }`), is treated as
+// contributing no promoted fields instead of being expanded again. Alongside
+// the fields it returns each one's embedding depth (0 for a direct field).
+func flattenFieldsVisiting(structType *types.Struct, byVar map[*types.Var]*Field, visiting map[*types.Named]bool) ([]*Field, []int) {
+	direct := make([]*Field, 0, structType.NumFields())
+	seen := map[string]bool{}
+
+	var promotedNames []string
+	promoted := map[string][]*Field{}
+	promotedDepth := map[string]int{}
+
+	for i := 0; i < structType.NumFields(); i++ {
+		v := structType.Field(i)
+
+		if v.Anonymous() {
+			if named, embedded, ok := underlyingStruct(v.Type()); ok {
+				if !visiting[named] {
+					visiting[named] = true
+					sub, subDepths := flattenFieldsVisiting(embedded, byVar, visiting)
+					for j, f := range sub {
+						name, depth := f.Name.Name, subDepths[j]+1
+						if d, ok := promotedDepth[name]; !ok {
+							promotedNames = append(promotedNames, name)
+						} else if depth > d {
+							continue // hidden by a shallower promotion
+						} else if depth < d {
+							promoted[name] = nil
+						}
+						promotedDepth[name] = depth
+						promoted[name] = append(promoted[name], f)
+					}
+					delete(visiting, named)
+				}
+				continue
+			}
+		}
+
+		if !v.Exported() {
+			continue
+		}
+
+		direct = append(direct, fieldForVar(v, byVar))
+		seen[v.Name()] = true
+	}
+
+	fields := direct
+	depths := make([]int, len(direct))
+	for _, name := range promotedNames {
+		if seen[name] {
+			continue // shadowed by a direct field
+		}
+		if candidates := promoted[name]; len(candidates) == 1 {
+			fields = append(fields, candidates[0])
+			depths = append(depths, promotedDepth[name])
+			seen[name] = true
+		}
+		// ambiguous promotions (len > 1) are only reachable via an explicit
+		// embedded-type selector and are intentionally left out here.
+	}
+
+	return fields, depths
+}
+
+func structsFromPackage(pkg *packages.Package) map[ast.TypeSpec][]*Field {
+	byVar := fieldByVar(pkg)
+	ret := map[ast.TypeSpec][]*Field{}
+
+	for _, file := range pkg.Syntax {
+		for _, decl := range file.Decls {
+			genDecl, ok := decl.(*ast.GenDecl)
+			if !ok || genDecl.Tok != token.TYPE {
+				continue
+			}
+
+			for _, spec := range genDecl.Specs {
+				typeSpec, ok := spec.(*ast.TypeSpec)
+				if !ok {
+					continue
+				}
+				if _, ok := typeSpec.Type.(*ast.StructType); !ok {
+					continue
+				}
+
+				if typeSpec.Doc == nil && genDecl.Lparen == token.NoPos {
+					// for an ungrouped "type T struct {...}" declaration the
+					// lead comment is only attached to the GenDecl; carry it
+					// down to the spec so callers always find it on TypeSpec.Doc.
+					typeSpec.Doc = genDecl.Doc
+				}
+
+				obj, ok := pkg.TypesInfo.Defs[typeSpec.Name]
+				if !ok || obj == nil {
+					continue
+				}
+				named, ok := obj.Type().(*types.Named)
+				if !ok {
+					continue
+				}
+				structType, ok := named.Underlying().(*types.Struct)
+				if !ok {
+					continue
+				}
+
+				fields := flattenFields(structType, byVar)
+				if len(fields) == 0 {
+					// a struct with no exported fields has nothing a
+					// QuerySet could be generated for; leave it out.
+					continue
+				}
+
+				ret[*typeSpec] = fields
+			}
+		}
+	}
+
+	return ret
+}
+
+// GetStructsInPackage loads the package rooted at dir as seen through src,
+// the files for the OS/arch/tags described by ctx (build.Default if ctx is
+// nil), and returns its *types.Package together with every struct type
+// declared in it, mapped to its fully resolved (embedding-expanded) field
+// list. Embedded types are followed regardless of declaration order, source
+// file, or whether they come from another package.
+func GetStructsInPackage(src Source, dir string, ctx *build.Context) (*types.Package, map[ast.TypeSpec][]*Field, error) {
+	realDir, cleanup, err := materializeDir(src, dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cleanup()
+
+	pkg, err := loadPackage(realDir, ctx, materializedEnv(src)...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return pkg.Types, structsFromPackage(pkg), nil
+}
+
+// GetStructsInFile is the single-file counterpart of GetStructsInPackage,
+// using the build.Default context: it discovers filePath's enclosing directory, loads
+// that whole package so embedded fields declared in sibling files or other
+// packages are resolved too, then filters the result down to the struct
+// types actually declared in filePath. filePath may itself be a _test.go
+// file, in which case the package is loaded with its test variants so that
+// file's own syntax is available to resolve against.
+func GetStructsInFile(src Source, filePath string) (*types.Package, map[ast.TypeSpec][]*Field, error) {
+	dir, base := splitSourcePath(src, filePath)
+
+	realDir, cleanup, err := materializeDir(src, dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cleanup()
+
+	absPath := filepath.Join(realDir, base)
+
+	pkgs, err := loadPackages(realDir, nil, strings.HasSuffix(base, "_test.go"), materializedEnv(src)...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pkg := packageContainingFile(pkgs, absPath)
+	if pkg == nil {
+		return nil, nil, fmt.Errorf("no package at %q has a file %q", realDir, base)
+	}
+	if len(pkg.Errors) > 0 {
+		return nil, nil, fmt.Errorf("can't load package at %q: %s", realDir, pkg.Errors[0])
+	}
+
+	structs := structsFromPackage(pkg)
+	ret := map[ast.TypeSpec][]*Field{}
+	for typeSpec, fields := range structs {
+		if pkg.Fset.Position(typeSpec.Pos()).Filename == absPath {
+			ret[typeSpec] = fields
+		}
+	}
+
+	return pkg.Types, ret, nil
+}
+
+// splitSourcePath splits filePath into the directory and base name
+// materializeDir and GetStructsInPackage expect: for OSSource that's an
+// ordinary filesystem path, for any other Source it's a slash-separated
+// path relative to the Source's root.
+func splitSourcePath(src Source, filePath string) (dir, base string) {
+	if _, ok := src.(OSSource); ok {
+		absPath, err := filepath.Abs(filePath)
+		if err != nil {
+			return filepath.Dir(filePath), filepath.Base(filePath)
+		}
+		return filepath.Dir(absPath), filepath.Base(absPath)
+	}
+
+	return path.Dir(filePath), path.Base(filePath)
+}
+
+// getStructNamesInFile returns every struct type declared in filePath,
+// keyed by its name. Unlike GetStructsInFile it only looks at filePath's
+// own syntax tree and does not resolve embedded fields.
+func getStructNamesInFile(src Source, filePath string) (map[string]*ast.TypeSpec, error) {
+	data, err := fs.ReadFile(src, filePath)
+	if err != nil {
+		return nil, fmt.Errorf("can't read file %q: %s", filePath, err)
+	}
+
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, filePath, data, parser.ParseComments)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse file %q: %s", filePath, err)
+	}
+
+	ret := map[string]*ast.TypeSpec{}
+	for _, decl := range f.Decls {
+		genDecl, ok := decl.(*ast.GenDecl)
+		if !ok || genDecl.Tok != token.TYPE {
+			continue
+		}
+
+		for _, spec := range genDecl.Specs {
+			typeSpec, ok := spec.(*ast.TypeSpec)
+			if !ok {
+				continue
+			}
+			if _, ok := typeSpec.Type.(*ast.StructType); !ok {
+				continue
+			}
+
+			ret[typeSpec.Name.Name] = typeSpec
+		}
+	}
+
+	return ret, nil
+}
+
+// fileNameToPkgName turns the absolute path of a file under $GOPATH/src into
+// its Go import path. It returns the directory unchanged if fileName isn't
+// rooted under any entry of $GOPATH.
+func fileNameToPkgName(fileName string) string {
+	dir := filepath.Dir(fileName)
+
+	for _, gopath := range filepath.SplitList(build.Default.GOPATH) {
+		srcDir := filepath.Join(gopath, "src") + string(filepath.Separator)
+		if strings.HasPrefix(dir, srcDir) {
+			return filepath.ToSlash(strings.TrimPrefix(dir, srcDir))
+		}
+	}
+
+	return dir
+}
@@ -1,14 +1,9 @@
 package parser
 
 import (
-	"crypto/rand"
-	"encoding/hex"
 	"fmt"
 	"go/ast"
-	"io/ioutil"
-	"log"
-	"os"
-	"path/filepath"
+	"go/build"
 	"runtime"
 	"strings"
 	"testing"
@@ -16,24 +11,6 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-func getRepoRoot() string {
-	_, selfFilePath, _, ok := runtime.Caller(0)
-	if !ok {
-		log.Fatalf("can't get caller")
-	}
-
-	root, err := filepath.Abs(filepath.Join(filepath.Dir(selfFilePath), ".."))
-	if err != nil {
-		log.Fatalf("can't get repo root: %s", err)
-	}
-
-	return root
-}
-
-func getTempDirRoot() string {
-	return filepath.Join(getRepoRoot(), "test")
-}
-
 func TestFileNameToPkgName(t *testing.T) {
 	_, selfFilePath, _, ok := runtime.Caller(0)
 	assert.True(t, ok)
@@ -46,43 +23,6 @@ func TestFileNameToPkgName(t *testing.T) {
 	assert.Equal(t, selfPkg, fileNameToPkgName(selfFilePath))
 }
 
-func getTempFileName(rootDir, prefix, suffix string) (*os.File, error) {
-	randBytes := make([]byte, 16)
-	_, err := rand.Read(randBytes)
-	if err != nil {
-		return nil, fmt.Errorf("can't generate random bytes: %s", err)
-	}
-
-	p := filepath.Join(rootDir, prefix+hex.EncodeToString(randBytes)+suffix)
-	return os.Create(p)
-}
-
-func getTmpFileForCode(code string) *os.File {
-	tmpDir, err := ioutil.TempDir(getTempDirRoot(), "tmptestdir")
-	if err != nil {
-		log.Fatalf("can't create temp dir: %s", err)
-	}
-
-	f, err := getTempFileName(tmpDir, "go-queryset-test", ".go")
-	if err != nil {
-		log.Fatalf("can't create temp file: %s", err)
-	}
-
-	_, err = f.Write([]byte(code))
-	if err != nil {
-		log.Fatalf("can't write to temp file %q: %s", f.Name(), err)
-	}
-
-	return f
-}
-
-func removeTempFileAndDir(f *os.File) {
-	root := filepath.Dir(f.Name())
-	if err := os.RemoveAll(root); err != nil {
-		log.Fatalf("can't remove files from root %s: %s", root, err)
-	}
-}
-
 func TestGetStructNamesInFile(t *testing.T) {
 	cases := []struct {
 		code                string
@@ -124,10 +64,9 @@ func TestGetStructNamesInFile(t *testing.T) {
 		tc := tc // capture range variable
 		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
 			t.Parallel()
-			f := getTmpFileForCode(tc.code)
-			defer removeTempFileAndDir(f)
+			src := MemSource(map[string]string{"p.go": tc.code})
 
-			res, err := getStructNamesInFile(f.Name())
+			res, err := getStructNamesInFile(src, "p.go")
 			if tc.errorIsExpected {
 				assert.NotNil(t, err)
 				return
@@ -222,9 +161,32 @@ func TestGetStructsInFile(t *testing.T) {
 				type m struct {
 					ID int
 				}`,
-			expectedStructFields: []string{"F"}, // TODO: support local reordered embedding
+			expectedStructFields: []string{"F", "ID"},
+			expectedStructsCount: 2,
+		},
+		{
+			code: `package p
+				type m struct {
+					F string
+				}
+
+				type T struct {
+					m
+					F int
+				}`,
+			expectedStructFields: []string{"F"}, // direct field shadows the promoted one
 			expectedStructsCount: 2,
 		},
+		{
+			code: `package p
+				import "image"
+
+				type T struct {
+					image.Point
+					F int
+				}`,
+			expectedStructFields: []string{"F", "X", "Y"},
+		},
 	}
 
 	for i, tc := range cases {
@@ -237,10 +199,9 @@ func TestGetStructsInFile(t *testing.T) {
 }
 
 func testStructFields(t *testing.T, tc structFieldsCase) {
-	f := getTmpFileForCode(tc.code)
-	defer removeTempFileAndDir(f)
+	src := MemSource(map[string]string{"p.go": tc.code})
 
-	pkg, structs, err := GetStructsInFile(f.Name())
+	pkg, structs, err := GetStructsInFile(src, "p.go")
 	if tc.errorIsExpected {
 		assert.NotNil(t, err)
 		return
@@ -281,4 +242,195 @@ func testStructFields(t *testing.T, tc structFieldsCase) {
 		}
 		assert.Equal(t, tc.expectedDoc, docLines)
 	}
-}
\ No newline at end of file
+}
+
+// TestGetStructsInFileCrossFile covers embedding a struct declared in
+// another file of the same package: the embedded struct itself must not
+// show up in the result (it's not declared in the requested file), but its
+// fields must still be promoted onto T.
+func TestGetStructsInFileCrossFile(t *testing.T) {
+	src := MemSource(map[string]string{
+		"base.go": `package p
+			type m struct {
+				ID int
+			}`,
+		"model.go": `package p
+			type T struct {
+				m
+				F int
+			}`,
+	})
+
+	_, structs, err := GetStructsInFile(src, "model.go")
+	assert.Nil(t, err)
+	assert.Len(t, structs, 1)
+
+	for typeSpec, fields := range structs {
+		assert.Equal(t, "T", typeSpec.Name.Name)
+		fieldNames := []string{}
+		for _, field := range fields {
+			fieldNames = append(fieldNames, field.Name.Name)
+		}
+		assert.Equal(t, []string{"F", "ID"}, fieldNames)
+	}
+}
+
+type fieldCommentCase struct {
+	code                string
+	expectedDoc         string
+	expectedLineComment string
+}
+
+func TestGetStructsInFileFieldComments(t *testing.T) {
+	cases := []fieldCommentCase{
+		{
+			code: `package p
+				type T struct {
+					// qs:index
+					// unique
+					F int
+				}`,
+			expectedDoc: "qs:index\nunique\n",
+		},
+		{
+			code: `package p
+				type T struct {
+					/* qs:unique */
+					F int // and indexed
+				}`,
+			expectedDoc:         "qs:unique\n",
+			expectedLineComment: "and indexed\n",
+		},
+		{
+			code: `package p
+				type T struct {
+					F int // qs:index
+				}`,
+			expectedLineComment: "qs:index\n",
+		},
+	}
+
+	for i, tc := range cases {
+		tc := tc // capture range variable
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			t.Parallel()
+
+			src := MemSource(map[string]string{"p.go": tc.code})
+
+			_, structs, err := GetStructsInFile(src, "p.go")
+			assert.Nil(t, err)
+
+			var field *Field
+			for typeSpec, fields := range structs {
+				if typeSpec.Name.Name != "T" {
+					continue
+				}
+				for _, fld := range fields {
+					if fld.Name.Name == "F" {
+						field = fld
+					}
+				}
+			}
+			assert.NotNil(t, field)
+
+			assert.Equal(t, tc.expectedDoc, field.Doc)
+			assert.Equal(t, tc.expectedLineComment, field.LineComment)
+		})
+	}
+}
+
+func hasStructNamed(structs map[ast.TypeSpec][]*Field, name string) bool {
+	for typeSpec := range structs {
+		if typeSpec.Name.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// TestGetStructsInPackageBuildConstraints checks that a file gated by a
+// //go:build constraint is only included for a matching build context.
+func TestGetStructsInPackageBuildConstraints(t *testing.T) {
+	src := MemSource(map[string]string{
+		"base.go": `package p
+			type T struct {
+				F int
+			}`,
+		"linux_only.go": "//go:build linux\n// +build linux\n\npackage p\n\ntype U struct {\n\tG int\n}\n",
+	})
+
+	linuxCtx := build.Default
+	linuxCtx.GOOS = "linux"
+	_, structs, err := GetStructsInPackage(src, ".", &linuxCtx)
+	assert.Nil(t, err)
+	assert.True(t, hasStructNamed(structs, "U"))
+
+	windowsCtx := build.Default
+	windowsCtx.GOOS = "windows"
+	_, structs, err = GetStructsInPackage(src, ".", &windowsCtx)
+	assert.Nil(t, err)
+	assert.False(t, hasStructNamed(structs, "U"))
+}
+
+// osSourceSentinel exists purely so TestGetStructsInFileOSSource has a
+// struct with an exported field to look for in this file's own source.
+type osSourceSentinel struct {
+	Sentinel int
+}
+
+// TestGetStructsInFileCyclicEmbedding covers self- and mutually-referential
+// pointer embeds. Both are legal, compiling Go (a struct may embed a
+// pointer to itself or to another struct that embeds a pointer back), but
+// naively recursing into every anonymous field's underlying struct would
+// never terminate, so GetStructsInFile must still return without crashing.
+func TestGetStructsInFileCyclicEmbedding(t *testing.T) {
+	cases := []struct {
+		name          string
+		code          string
+		expectedNamed string
+	}{
+		{
+			name: "self",
+			code: `package p
+				type T struct {
+					*T
+					F int
+				}`,
+			expectedNamed: "T",
+		},
+		{
+			name: "mutual",
+			code: `package p
+				type A struct {
+					*B
+					F int
+				}
+				type B struct {
+					*A
+					G int
+				}`,
+			expectedNamed: "A",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc // capture range variable
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			src := MemSource(map[string]string{"p.go": tc.code})
+			_, structs, err := GetStructsInFile(src, "p.go")
+			assert.Nil(t, err)
+			assert.True(t, hasStructNamed(structs, tc.expectedNamed))
+		})
+	}
+}
+
+func TestGetStructsInFileOSSource(t *testing.T) {
+	_, selfFilePath, _, ok := runtime.Caller(0)
+	assert.True(t, ok)
+
+	_, structs, err := GetStructsInFile(OSSource{}, selfFilePath)
+	assert.Nil(t, err)
+	assert.True(t, hasStructNamed(structs, "osSourceSentinel"))
+}